@@ -0,0 +1,34 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The cpc-server command serves the remote side of cpc's delta-sync
+// protocol over its own stdin/stdout, for a single session. It's meant to
+// be launched as `ssh host cpc-server`, the mode cpc uses for an ssh://
+// destination, so the session inherits ssh's authentication instead of
+// needing its own: cpc-server has no authentication of its own, and must
+// never be exposed on a socket anyone can connect to.
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+
+	"github.com/tailscale/cpc/cpc"
+)
+
+func main() {
+	ctx := context.Background()
+	if err := cpc.ServeConn(ctx, log.Printf, stdioConn{}); err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+}
+
+// stdioConn adapts os.Stdin/os.Stdout into the io.ReadWriteCloser ServeConn
+// expects.
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdioConn) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdioConn) Close() error                { return nil }
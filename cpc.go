@@ -12,30 +12,112 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/tailscale/cpc/cpc"
 )
 
+var (
+	rolling       = flag.Bool("rolling", false, "use rsync-style rolling-hash delta matching instead of fixed-page comparison; handles shifted/inserted content at the cost of more CPU")
+	chunked       = flag.Bool("chunked", false, "use content-defined chunking (FastCDC) instead of fixed-page comparison; handles shifted/inserted content without rolling's per-byte scan cost")
+	writeManifest = flag.String("write-manifest", "", "after copying, write a per-page digest manifest to this path")
+	verify        = flag.Bool("verify", false, "instead of copying, check <file> against the manifest <file>.toc (or the second argument if given) and report corrupted pages")
+	sparse        = flag.Bool("sparse", false, "punch holes for all-zero pages instead of writing zeroes, to preserve dst's sparseness (Linux only)")
+	direct        = flag.Bool("direct", false, "bypass the page cache with O_DIRECT where possible")
+	fsync         = flag.Bool("fsync", false, "fsync dst before returning")
+)
+
+// copyFunc is the common shape of cpc.Copy and cpc.CopyRolling, so main can
+// pick one based on flags without duplicating the directory/single-file
+// dispatch logic below.
+type copyFunc func(ctx context.Context, logf cpc.Logf, srcName, dstName string) (*cpc.Stats, error)
+
 func main() {
 	flag.Parse()
 	n := flag.NArg()
+
+	if *verify {
+		if n < 1 || n > 2 {
+			log.Fatalf("usage: cpc -verify <file> [manifest]")
+		}
+		fileName := flag.Arg(0)
+		manifestName := fileName + ".toc"
+		if n == 2 {
+			manifestName = flag.Arg(1)
+		}
+		report, err := cpc.VerifyManifest(context.Background(), log.Printf, fileName, manifestName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(report.Corrupt) == 0 {
+			log.Printf("%v: all %v pages match %v", fileName, report.PagesChecked, manifestName)
+			return
+		}
+		for _, c := range report.Corrupt {
+			log.Printf("corrupt: page %v at offset %v, len %v", c.PageIndex, c.Offset, c.Len)
+		}
+		log.Fatalf("%v: %v of %v pages corrupt", fileName, len(report.Corrupt), report.PagesChecked)
+	}
+
 	if n < 2 {
 		log.Fatalf("usage: cpc <from...> <to>")
 	}
+	if *rolling && *chunked {
+		log.Fatalf("-rolling and -chunked are mutually exclusive")
+	}
 	last := flag.Arg(n - 1)
+	isRemoteDest := strings.HasPrefix(last, "ssh://")
 	var lastIsDir bool
-	if fi, err := os.Stat(last); err == nil && fi.IsDir() {
-		lastIsDir = true
+	if !isRemoteDest {
+		if fi, err := os.Stat(last); err == nil && fi.IsDir() {
+			lastIsDir = true
+		}
 	}
 	if n > 2 && !lastIsDir {
 		log.Fatalf("with more than two arguments, final one must be a directory")
 	}
 	ctx := context.Background()
+
+	if isRemoteDest {
+		if n != 2 {
+			log.Fatalf("an ssh:// destination only supports a single source file")
+		}
+		if *rolling || *chunked {
+			log.Fatalf("-rolling and -chunked aren't supported against a remote destination yet")
+		}
+		if _, err := cpc.RemoteCopy(ctx, log.Printf, flag.Arg(0), last); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	plainOpts := cpc.Options{
+		WriteManifest: *writeManifest,
+		Sparse:        *sparse,
+		Direct:        *direct,
+		Fsync:         *fsync,
+	}
+	copyFn := copyFunc(func(ctx context.Context, logf cpc.Logf, srcName, dstName string) (*cpc.Stats, error) {
+		return cpc.Copy(ctx, logf, srcName, dstName, plainOpts)
+	})
+	switch {
+	case *rolling:
+		if *writeManifest != "" || *sparse || *direct || *fsync {
+			log.Fatalf("-write-manifest, -sparse, -direct, and -fsync aren't supported with -rolling")
+		}
+		copyFn = cpc.CopyRolling
+	case *chunked:
+		if *writeManifest != "" || *sparse || *direct || *fsync {
+			log.Fatalf("-write-manifest, -sparse, -direct, and -fsync aren't supported with -chunked")
+		}
+		copyFn = func(ctx context.Context, logf cpc.Logf, srcName, dstName string) (*cpc.Stats, error) {
+			return cpc.Copy(ctx, logf, srcName, dstName, cpc.WithChunker(cpc.FastCDC{}))
+		}
+	}
 	// Directory copy mode.
 	if lastIsDir {
 		for _, srcName := range flag.Args()[:n-1] {
 			dstName := filepath.Join(last, filepath.Base(srcName))
-			if _, err := cpc.Copy(ctx, log.Printf, srcName, dstName); err != nil {
+			if _, err := copyFn(ctx, log.Printf, srcName, dstName); err != nil {
 				log.Fatal(err)
 			}
 		}
@@ -43,7 +125,7 @@ func main() {
 	}
 	// Single file copy mode.
 	srcName, dstName := flag.Arg(0), flag.Arg(1)
-	if _, err := cpc.Copy(ctx, log.Printf, srcName, dstName); err != nil {
+	if _, err := copyFn(ctx, log.Printf, srcName, dstName); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,18 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import "unsafe"
+
+// alignedBuffer returns a byte slice of length n whose backing array starts
+// at an address aligned to directAlign, as O_DIRECT reads and writes
+// require.
+func alignedBuffer(n int) []byte {
+	buf := make([]byte, n+directAlign)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directAlign); rem != 0 {
+		off = directAlign - rem
+	}
+	return buf[off : off+n : off+n]
+}
@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FastCDC configures content-defined chunking: instead of cutting a file
+// into fixed-size pages, chunk boundaries are placed wherever a rolling
+// buzhash over the content happens to satisfy a cut-point predicate. That
+// makes the chunk boundaries stable across insertions and deletions
+// elsewhere in the file, which fixed-offset paging can't offer.
+type FastCDC struct {
+	Min int // smallest allowed chunk, default 2KiB
+	Avg int // target average chunk size, default 8KiB
+	Max int // largest allowed chunk before a forced cut, default 64KiB
+}
+
+func (c FastCDC) withDefaults() FastCDC {
+	if c.Min == 0 {
+		c.Min = 2 << 10
+	}
+	if c.Avg == 0 {
+		c.Avg = 8 << 10
+	}
+	if c.Max == 0 {
+		c.Max = 64 << 10
+	}
+	return c
+}
+
+// buzWindow is the size, in bytes, of the buzhash window.
+const buzWindow = 64
+
+// buzTable maps each byte value to a fixed pseudo-random 64-bit word. It's
+// seeded deterministically so that chunk boundaries are reproducible between
+// runs on the same content.
+var buzTable = func() (t [256]uint64) {
+	r := mathrand.New(mathrand.NewSource(0x63706363646361)) // fixed seed: deterministic, reproducible cut points
+	for i := range t {
+		t[i] = r.Uint64()
+	}
+	return t
+}()
+
+func rotl64(x uint64, k uint) uint64 {
+	k %= 64
+	return bits.RotateLeft64(x, int(k))
+}
+
+// cdcChunk is one content-defined chunk of a file.
+type cdcChunk struct {
+	Off int64
+	Len int
+}
+
+// digest256 is a full SHA-256 digest, used as the key identifying a chunk's
+// content.
+type digest256 [32]byte
+
+func chunkDigest(b []byte) digest256 {
+	return sha256.Sum256(b)
+}
+
+// scanCDC reads all of r and cuts it into content-defined chunks per cfg,
+// using a rolling buzhash over a buzWindow-byte window and normalized
+// chunking: a stricter (harder to satisfy) mask below cfg.Avg and a looser
+// one above it, so chunk sizes cluster around the average instead of
+// following a raw geometric distribution. It returns each chunk's
+// offset/length alongside its content digest, computed incrementally as r
+// is read rather than requiring the whole of r to be buffered at once.
+func scanCDC(r io.Reader, cfg FastCDC) ([]cdcChunk, []digest256, error) {
+	cfg = cfg.withDefaults()
+	if cfg.Min <= 0 || cfg.Avg <= 0 || cfg.Max <= 0 || cfg.Min > cfg.Avg || cfg.Avg > cfg.Max {
+		return nil, nil, fmt.Errorf("cpc: invalid FastCDC config: need 0 < Min (%d) <= Avg (%d) <= Max (%d)", cfg.Min, cfg.Avg, cfg.Max)
+	}
+	bitsAvg := bits.Len(uint(cfg.Avg)) - 1
+	if bitsAvg < 1 {
+		bitsAvg = 1
+	}
+	const normLevel = 2
+	maskSmall := uint64(1)<<uint(bitsAvg+normLevel) - 1 // stricter: more bits, harder to hit
+	maskLarge := uint64(1)<<uint(bitsAvg-normLevel) - 1 // looser: fewer bits, easier to hit
+
+	br := bufio.NewReaderSize(r, 1<<20)
+
+	var chunks []cdcChunk
+	var digests []digest256
+	start := int64(0)
+	off := int64(0)
+	size := 0 // bytes accumulated into the current chunk
+	// chunkBuf accumulates the current chunk's bytes, up to cfg.Max, so its
+	// digest can be computed in one sha256.Sum256 call at the cut point
+	// instead of one hash.Write per byte.
+	chunkBuf := make([]byte, cfg.Max)
+	var hWin uint64
+	var window [buzWindow]byte
+	wlen := 0 // bytes currently in the window, caps at buzWindow
+
+	cut := func() {
+		chunks = append(chunks, cdcChunk{Off: start, Len: size})
+		digests = append(digests, chunkDigest(chunkBuf[:size]))
+		start = off
+		size = 0
+		hWin = 0
+		wlen = 0
+	}
+
+	for {
+		bIn, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		chunkBuf[size] = bIn
+		size++
+		off++
+		// relIdx is the write/evict slot within the window, relative to the
+		// start of the *current chunk* rather than the absolute stream
+		// offset — otherwise identical content occurring at two
+		// differently-aligned offsets would roll to different hashes and
+		// never be recognized as the same chunk.
+		relIdx := (size - 1) % buzWindow
+		if wlen < buzWindow {
+			hWin = rotl64(hWin, 1) ^ buzTable[bIn]
+			window[relIdx] = bIn
+			wlen++
+		} else {
+			bOut := window[relIdx]
+			hWin = rotl64(hWin, 1) ^ buzTable[bIn] ^ rotl64(buzTable[bOut], buzWindow)
+			window[relIdx] = bIn
+		}
+
+		if size < cfg.Min {
+			continue
+		}
+		mask := maskLarge
+		if size < cfg.Avg {
+			mask = maskSmall
+		}
+		if hWin&mask == 0 || size >= cfg.Max {
+			cut()
+		}
+	}
+	if size > 0 {
+		cut()
+	}
+	return chunks, digests, nil
+}
+
+// copyChunked implements Copy for the Options.Chunker case: it cuts both
+// src and dst into content-defined chunks and, for each source chunk,
+// either skips it (identical content already at the same offset in dst),
+// relocates it (identical content exists in dst at a different offset, so
+// it's copied across rather than rewritten), or writes it fresh.
+func copyChunked(ctx context.Context, logf Logf, srcName, dstName string, cfg FastCDC) (*Stats, error) {
+	t0 := time.Now()
+
+	srcF, err := os.Open(srcName)
+	if err != nil {
+		return nil, err
+	}
+	defer srcF.Close()
+	srcFi, err := srcF.Stat()
+	if err != nil {
+		return nil, err
+	}
+	srcSize := srcFi.Size()
+
+	dstF, err := os.OpenFile(dstName, os.O_CREATE|os.O_RDWR, srcFi.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	defer dstF.Close()
+	dstFi, err := dstF.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dstSize := dstFi.Size()
+
+	// Snapshot dst's current content to a temp file before writing
+	// anything: relocation reads below need dst's *original* bytes, and an
+	// earlier iteration of the write loop may already have overwritten that
+	// region on disk by the time a later iteration wants to relocate from
+	// it.
+	snapF, err := ioutil.TempFile(filepath.Dir(dstName), filepath.Base(dstName)+".cpc-chunked-*")
+	if err != nil {
+		return nil, err
+	}
+	snapName := snapF.Name()
+	defer os.Remove(snapName)
+	defer snapF.Close()
+	if _, err := io.Copy(snapF, io.NewSectionReader(dstF, 0, dstSize)); err != nil {
+		return nil, fmt.Errorf("snapshotting dst: %w", err)
+	}
+
+	srcChunks, srcDigests, err := scanCDC(srcF, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("chunking src: %w", err)
+	}
+	if _, err := snapF.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	dstChunks, dstDigests, err := scanCDC(snapF, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("chunking dst: %w", err)
+	}
+	logf("chunked src into %v chunks, dst into %v chunks (min=%v avg=%v max=%v)",
+		len(srcChunks), len(dstChunks), cfg.withDefaults().Min, cfg.withDefaults().Avg, cfg.withDefaults().Max)
+
+	dstByOffset := make(map[int64]digest256, len(dstChunks))
+	dstByDigest := make(map[digest256]int64, len(dstChunks))
+	for i, c := range dstChunks {
+		d := dstDigests[i]
+		dstByOffset[c.Off] = d
+		// First offset wins on duplicate content; any one is a valid
+		// relocation source.
+		if _, ok := dstByDigest[d]; !ok {
+			dstByDigest[d] = c.Off
+		}
+	}
+
+	if err := dstF.Truncate(srcSize); err != nil {
+		return nil, err
+	}
+
+	var deduped, relocated, written int64
+	maxChunk := int64(cfg.withDefaults().Max)
+	buf := make([]byte, maxChunk)
+	for i, c := range srcChunks {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d := srcDigests[i]
+		if same, ok := dstByOffset[c.Off]; ok && same == d && int64(c.Len) <= dstSize-c.Off {
+			deduped++
+			continue
+		}
+		if relOff, ok := dstByDigest[d]; ok {
+			b := buf[:c.Len]
+			// Read the relocation source from the pre-write snapshot, not
+			// from dstF: an earlier iteration in this same loop may already
+			// have overwritten that region on disk.
+			if _, err := snapF.ReadAt(b, relOff); err != nil {
+				return nil, fmt.Errorf("reading relocated chunk at %d: %w", relOff, err)
+			}
+			if _, err := dstF.WriteAt(b, c.Off); err != nil {
+				return nil, fmt.Errorf("writing relocated chunk at %d: %w", c.Off, err)
+			}
+			relocated++
+			continue
+		}
+		b := buf[:c.Len]
+		if _, err := srcF.ReadAt(b, c.Off); err != nil {
+			return nil, fmt.Errorf("reading src chunk at %d: %w", c.Off, err)
+		}
+		if _, err := dstF.WriteAt(b, c.Off); err != nil {
+			return nil, err
+		}
+		written++
+	}
+
+	d := time.Since(t0)
+	logf("chunked copy done in %v: %v deduped, %v relocated, %v written",
+		d.Round(time.Millisecond), deduped, relocated, written)
+	return &Stats{
+		Duration:        d,
+		ChunksDeduped:   deduped,
+		ChunksRelocated: relocated,
+		ChunksWritten:   written,
+	}, nil
+}
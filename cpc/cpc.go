@@ -7,9 +7,9 @@
 package cpc
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"sync/atomic"
@@ -24,21 +24,57 @@ type Stats struct {
 	PageSize        int64
 	PagesWritten    int64
 	PagesUnmodified int64
+
+	// BytesMatched, BytesLiteral, and WindowsScanned are populated by
+	// CopyRolling; they're zero for the regular aligned-page Copy.
+	BytesMatched   int64 // bytes satisfied by a rolling-hash match against dst
+	BytesLiteral   int64 // bytes that had to be written fresh from src
+	WindowsScanned int64 // number of rolling-window positions examined
+
+	// ChunksDeduped, ChunksRelocated, and ChunksWritten are populated by
+	// Copy when called with Options.Chunker set; they're zero otherwise.
+	ChunksDeduped   int64 // chunks already identical at the same dst offset
+	ChunksRelocated int64 // chunks found elsewhere in dst and copied across
+	ChunksWritten   int64 // chunks with no match in dst, written fresh
+
+	// PagesPunched counts all-zero pages that were hole-punched into dst
+	// instead of written, when Options.Sparse is set.
+	PagesPunched int64
 }
 
-const pgSize = 4 << 10
+// defaultPageSize is used when the source isn't recognized as SQLite and
+// Options.PageSize wasn't given.
+const defaultPageSize = 4 << 10
 
-// Page is a 4K page of a file.
+// Page is a fixed-size page of a file, usually 4K but see Options.PageSize
+// and the SQLite auto-detection in Copy.
 type Page struct {
-	Off int64 // always 4K aligned
-	Len int   // usually 4K, except at the tail
+	Off int64 // always aligned to the page size in use
+	Len int   // usually the full page size, except at the tail
 }
 
 // Logf is a logger that takes a format string and arguments.
 type Logf func(format string, args ...interface{})
 
-// Copy provides a concurrent blockwise copy of srcName to dstName.
-func Copy(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, error) {
+// Copy provides a concurrent blockwise copy of srcName to dstName. By
+// default it compares fixed-size pages: the page size from src's header if
+// src is a SQLite database, else 4K. Pass an Options value (for example
+// from WithChunker) to change that.
+func Copy(ctx context.Context, logf Logf, srcName, dstName string, opts ...Options) (*Stats, error) {
+	var o Options
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.PageSize < 0 {
+		return nil, fmt.Errorf("cpc: Options.PageSize must be >= 0, got %d", o.PageSize)
+	}
+	if o.Chunker != nil {
+		if o.PageSize != 0 || o.WriteManifest != "" || o.VerifyManifest != "" || o.Sparse || o.Direct || o.Fsync {
+			return nil, fmt.Errorf("cpc: PageSize, WriteManifest, VerifyManifest, Sparse, Direct, and Fsync aren't supported together with Chunker")
+		}
+		return copyChunked(ctx, logf, srcName, dstName, *o.Chunker)
+	}
+
 	numCPU := runtime.NumCPU()
 
 	t0 := time.Now()
@@ -55,6 +91,19 @@ func Copy(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, erro
 	}
 	size := fi.Size()
 
+	pageSize := int64(o.PageSize)
+	if pageSize == 0 {
+		detected, ok, err := detectSQLitePageSize(srcF)
+		if err != nil {
+			return nil, fmt.Errorf("detecting SQLite page size: %w", err)
+		}
+		if ok {
+			pageSize = detected
+		} else {
+			pageSize = defaultPageSize
+		}
+	}
+
 	dstF, err := os.OpenFile(dstName, os.O_CREATE|os.O_RDWR, fi.Mode().Perm())
 	if err != nil {
 		return nil, err
@@ -63,20 +112,35 @@ func Copy(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, erro
 		return nil, err
 	}
 
-	pages := 0
-	workc := make(chan Page, size/pgSize+1)
-	remainSize := size
-	off := int64(0)
-	for remainSize > 0 {
-		chunkSize := remainSize
-		if chunkSize > pgSize {
-			chunkSize = pgSize
+	// srcDirectF and dstDirectF are only used for pages that are exactly a
+	// full pageSize long, which is the common case: O_DIRECT requires
+	// aligned lengths, and the final partial page at EOF usually isn't
+	// one. The regular srcF/dstF handle that remainder.
+	var srcDirectF, dstDirectF *os.File
+	if o.Direct {
+		srcDirectF, err = openDirect(srcName, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("opening src with O_DIRECT: %w", err)
 		}
-		p := Page{Off: off, Len: int(chunkSize)}
-		remainSize -= chunkSize
-		off += chunkSize
-		pages++
-		workc <- p
+		defer srcDirectF.Close()
+		dstDirectF, err = openDirect(dstName, os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("opening dst with O_DIRECT: %w", err)
+		}
+		defer dstDirectF.Close()
+	}
+
+	s := Syncer{PageSize: pageSize}
+	numPages := s.NumPages(size)
+	pages := int(numPages)
+	workc := make(chan Page, numPages)
+	for i := int64(0); i < numPages; i++ {
+		off := i * pageSize
+		ln := pageSize
+		if rem := size - off; rem < ln {
+			ln = rem
+		}
+		workc <- Page{Off: off, Len: int(ln)}
 	}
 	close(workc)
 
@@ -85,25 +149,44 @@ func Copy(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, erro
 
 	var pagesUnmodified atomicInt64
 	var pagesWritten atomicInt64
+	var pagesPunched atomicInt64
 	var pagesTotal atomicInt64
 
+	isZero := func(b []byte) bool {
+		for _, c := range b {
+			if c != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
 	copyPage := func(p Page, bufSrc, bufDst []byte) error {
 		bufSrc = bufSrc[:p.Len]
 		bufDst = bufDst[:p.Len]
-		// Note: ReadAt doesn't do short reads like io.Reader. Also, these two
-		// ReadAt calls could be in theory be concurrent but we're already
-		// running NumCPUs goroutines, so it wouldn't really help.
-		if _, err := srcF.ReadAt(bufSrc, p.Off); err != nil {
-			return err
+		srcR, dstR, dstW := io.ReaderAt(srcF), io.ReaderAt(dstF), io.WriterAt(dstF)
+		if o.Direct && p.Len == int(pageSize) {
+			srcR, dstR, dstW = srcDirectF, dstDirectF, dstDirectF
 		}
-		if _, err := dstF.ReadAt(bufDst, p.Off); err != nil {
+		// Note: these two reads could in theory be concurrent but we're
+		// already running NumCPUs goroutines, so it wouldn't really help.
+		same, err := s.SamePageInto(srcR, dstR, p.Off, bufSrc, bufDst)
+		if err != nil {
 			return err
 		}
-		if bytes.Equal(bufSrc, bufDst) {
+		if same {
 			pagesUnmodified.Add(1)
 			return nil
 		}
-		if _, err := dstF.WriteAt(bufSrc, p.Off); err != nil {
+		if o.Sparse && isZero(bufSrc) {
+			if punched, err := punchHole(dstF, p.Off, p.Len); err != nil {
+				return err
+			} else if punched {
+				pagesPunched.Add(1)
+				return nil
+			}
+		}
+		if _, err := dstW.WriteAt(bufSrc, p.Off); err != nil {
 			return err
 		}
 		pagesWritten.Add(1)
@@ -121,8 +204,18 @@ func Copy(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, erro
 	grp, ctx := errgroup.WithContext(ctx)
 	for i := 0; i < numCPU; i++ {
 		grp.Go(func() error {
-			bufSrc := make([]byte, pgSize)
-			bufDst := make([]byte, pgSize)
+			var bufSrc, bufDst []byte
+			if o.Direct {
+				// O_DIRECT requires aligned buffers. This worker uses the
+				// same buffers for pages read through the O_DIRECT handles
+				// and through the regular ones, so just always use aligned
+				// ones here.
+				bufSrc = alignedBuffer(int(pageSize))
+				bufDst = alignedBuffer(int(pageSize))
+			} else {
+				bufSrc = make([]byte, pageSize)
+				bufDst = make([]byte, pageSize)
+			}
 			for {
 				select {
 				case <-ctx.Done():
@@ -150,14 +243,42 @@ func Copy(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, erro
 	printProgress()
 	d := time.Since(t0)
 	logf("Done in %v", d.Round(time.Millisecond))
-	if pagesWritten.Load()+pagesUnmodified.Load() != int64(pages) {
+	if pagesWritten.Load()+pagesUnmodified.Load()+pagesPunched.Load() != int64(pages) {
 		return nil, fmt.Errorf("not consistent; expected %v pages total", pages)
 	}
+
+	if o.Fsync {
+		if err := dstF.Sync(); err != nil {
+			return nil, fmt.Errorf("fsyncing dst: %w", err)
+		}
+	}
+
+	if o.WriteManifest != "" {
+		m, err := buildManifest(dstF, size, pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("building manifest: %w", err)
+		}
+		if err := writeManifestFile(o.WriteManifest, m); err != nil {
+			return nil, fmt.Errorf("writing manifest %v: %w", o.WriteManifest, err)
+		}
+		logf("wrote manifest %v (%v pages)", o.WriteManifest, len(m.Entries))
+	}
+	if o.VerifyManifest != "" {
+		report, err := VerifyManifest(ctx, logf, dstName, o.VerifyManifest)
+		if err != nil {
+			return nil, fmt.Errorf("verifying against manifest: %w", err)
+		}
+		if len(report.Corrupt) > 0 {
+			return nil, fmt.Errorf("dst %v doesn't match manifest %v: %v corrupt page(s)", dstName, o.VerifyManifest, len(report.Corrupt))
+		}
+	}
+
 	return &Stats{
 		Duration:        d,
-		PageSize:        pgSize,
+		PageSize:        pageSize,
 		PagesWritten:    pagesWritten.Load(),
 		PagesUnmodified: pagesUnmodified.Load(),
+		PagesPunched:    pagesPunched.Load(),
 	}, nil
 }
 
@@ -7,9 +7,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	mathrand "math/rand"
+	"net"
+	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
@@ -77,6 +80,339 @@ func TestCopyBlockwise(t *testing.T) {
 	}
 }
 
+func TestCopyRolling(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	orig := randBytes(10 * rollBlock)
+	if err := ioutil.WriteFile(dst, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Shift everything after the first block by one byte, so the
+	// page-aligned fast path would have to rewrite the whole rest of the
+	// file, but the rolling matcher should still find every later block.
+	shifted := append(append([]byte{}, orig[:rollBlock]...), byte(0xAB))
+	shifted = append(shifted, orig[rollBlock:]...)
+	if err := ioutil.WriteFile(src, shifted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := CopyRolling(context.Background(), loggerDiscard, src, dst)
+	if err != nil {
+		t.Fatalf("CopyRolling: %v", err)
+	}
+	if st.BytesMatched == 0 {
+		t.Errorf("BytesMatched = 0; want >0 for shifted-but-repeated content")
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, shifted) {
+		t.Fatalf("dst bytes didn't match src after CopyRolling")
+	}
+}
+
+func TestCopyRollingPreservesSrcPerm(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	if err := ioutil.WriteFile(src, randBytes(rollBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CopyRolling(context.Background(), loggerDiscard, src, dst); err != nil {
+		t.Fatalf("CopyRolling: %v", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("new dst perm = %v; want 0600 (inherited from src)", fi.Mode().Perm())
+	}
+}
+
+func TestCopySQLitePageSize(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src.db")
+	dst := filepath.Join(td, "dst.db")
+
+	const pageSize = 16 << 10
+	data := make([]byte, pageSize*3)
+	copy(data, sqliteMagic)
+	binary.BigEndian.PutUint16(data[16:18], pageSize)
+	rand.Read(data[18:])
+
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := Copy(context.Background(), loggerDiscard, src, dst)
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if st.PageSize != pageSize {
+		t.Errorf("PageSize = %v; want %v (auto-detected from SQLite header)", st.PageSize, pageSize)
+	}
+
+	// An explicit override takes precedence, even for a detected SQLite file.
+	st, err = Copy(context.Background(), loggerDiscard, src, dst, Options{PageSize: 4096})
+	if err != nil {
+		t.Fatalf("Copy with override: %v", err)
+	}
+	if st.PageSize != 4096 {
+		t.Errorf("PageSize with override = %v; want 4096", st.PageSize)
+	}
+}
+
+func TestCopySQLiteCorruptPageSize(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "corrupt.db")
+	dst := filepath.Join(td, "dst.db")
+
+	// Magic string present, but the page-size field at offset 16 is zeroed
+	// out, which is not a valid SQLite page size.
+	data := make([]byte, 100)
+	copy(data, sqliteMagic)
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(context.Background(), loggerDiscard, src, dst); err == nil {
+		t.Fatal("Copy succeeded on a file with an invalid SQLite page-size field; want error")
+	}
+}
+
+func TestCopyRejectsNegativePageSize(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	if err := ioutil.WriteFile(src, randBytes(4<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(context.Background(), loggerDiscard, src, dst, Options{PageSize: -1}); err == nil {
+		t.Fatal("Copy succeeded with a negative Options.PageSize; want error")
+	}
+}
+
+func TestCopyChunked(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	orig := randBytes(256 << 10)
+	if err := ioutil.WriteFile(dst, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Insert a few bytes near the start; content-defined chunking should
+	// still recognize most of the rest of the file as unchanged, just at a
+	// shifted offset.
+	shifted := append(append([]byte{}, orig[:1000]...), []byte("hello world")...)
+	shifted = append(shifted, orig[1000:]...)
+	if err := ioutil.WriteFile(src, shifted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := Copy(context.Background(), loggerDiscard, src, dst, WithChunker(FastCDC{}))
+	if err != nil {
+		t.Fatalf("Copy with chunker: %v", err)
+	}
+	if st.ChunksRelocated == 0 {
+		t.Errorf("ChunksRelocated = 0; want >0 for shifted-but-repeated content")
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, shifted) {
+		t.Fatalf("dst bytes didn't match src after chunked Copy")
+	}
+
+	// Chunker combined with an incompatible option is rejected outright,
+	// rather than silently ignoring the option.
+	_, err = Copy(context.Background(), loggerDiscard, src, dst, Options{Chunker: &FastCDC{}, Fsync: true})
+	if err == nil {
+		t.Fatal("Copy with Chunker and Fsync both set succeeded; want error")
+	}
+}
+
+func TestCopyChunkedPreservesSrcPerm(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	if err := ioutil.WriteFile(src, randBytes(64<<10), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(context.Background(), loggerDiscard, src, dst, WithChunker(FastCDC{})); err != nil {
+		t.Fatalf("Copy with chunker: %v", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("new dst perm = %v; want 0600 (inherited from src)", fi.Mode().Perm())
+	}
+}
+
+func TestScanCDCRejectsMinGreaterThanMax(t *testing.T) {
+	// Min > Max would otherwise overrun a chunkBuf sized to Max alone.
+	_, _, err := scanCDC(bytes.NewReader(randBytes(40<<10)), FastCDC{Min: 100 << 10, Max: 4 << 10, Avg: 8 << 10})
+	if err == nil {
+		t.Fatal("scanCDC accepted Min > Max; want error")
+	}
+}
+
+func TestCopySparseDirectFsync(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	want := make([]byte, 3*(4<<10))
+	copy(want, randBytes(4<<10)) // page 0: non-zero
+	// page 1 left all-zero
+	copy(want[2*(4<<10):], randBytes(4<<10)) // page 2: non-zero
+	if err := ioutil.WriteFile(src, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Seed dst with non-zero bytes so its page 1 differs from src's
+	// all-zero page 1; a fresh, truncated dst would already read as zeros
+	// there and count the page as unmodified.
+	if err := ioutil.WriteFile(dst, randBytes(len(want)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := Copy(context.Background(), loggerDiscard, src, dst, Options{Sparse: true, Direct: true, Fsync: true})
+	if err != nil {
+		t.Fatalf("Copy with Sparse/Direct/Fsync: %v", err)
+	}
+	// Whether the all-zero page was actually punched depends on OS and
+	// filesystem support; either way it must count as written or punched,
+	// and the resulting bytes must match exactly.
+	if st.PagesWritten+st.PagesPunched == 0 {
+		t.Errorf("PagesWritten+PagesPunched = 0; want >0")
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("dst bytes didn't match src")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+	manifest := filepath.Join(td, "dst.toc")
+
+	want := randBytes(3 * (4 << 10))
+	if err := ioutil.WriteFile(src, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Copy(context.Background(), loggerDiscard, src, dst, Options{WriteManifest: manifest}); err != nil {
+		t.Fatalf("Copy with WriteManifest: %v", err)
+	}
+	if _, err := os.Stat(manifest); err != nil {
+		t.Fatalf("manifest wasn't written: %v", err)
+	}
+
+	report, err := VerifyManifest(context.Background(), loggerDiscard, dst, manifest)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(report.Corrupt) != 0 {
+		t.Errorf("Corrupt = %v; want none", report.Corrupt)
+	}
+
+	// Flip a byte on disk and confirm VerifyManifest catches it.
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xFF
+	if err := ioutil.WriteFile(dst, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifyManifest(context.Background(), loggerDiscard, dst, manifest)
+	if err != nil {
+		t.Fatalf("VerifyManifest after corruption: %v", err)
+	}
+	if len(report.Corrupt) != 1 {
+		t.Errorf("Corrupt = %v; want exactly 1 page", report.Corrupt)
+	}
+}
+
+func TestRemoteCopy(t *testing.T) {
+	td := t.TempDir()
+	src := filepath.Join(td, "src")
+	dst := filepath.Join(td, "dst")
+
+	want := randBytes(3 * (4 << 10))
+	if err := ioutil.WriteFile(src, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Seed dst so one page already matches, exercising the "skip unchanged
+	// page" path over the wire too.
+	// Page 0 matches, page 1 differs by one byte, page 2 is missing.
+	seed := append([]byte(nil), want...)
+	seed[4<<10] ^= 0xFF
+	if err := ioutil.WriteFile(dst, seed[:2*(4<<10)], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drive the protocol over an in-process net.Pipe, with ServeConn on one
+	// end and remoteCopyConn (RemoteCopy's wire-protocol client) on the
+	// other, instead of a real ssh session or a listening socket.
+	clientConn, serverConn := net.Pipe()
+	go ServeConn(context.Background(), loggerDiscard, serverConn)
+
+	srcF, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srcF.Close()
+
+	st, err := remoteCopyConn(context.Background(), loggerDiscard, srcF, dst, clientConn)
+	if err != nil {
+		t.Fatalf("RemoteCopy: %v", err)
+	}
+	if st.PagesWritten == 0 {
+		t.Errorf("PagesWritten = 0; want >0")
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("dst bytes didn't match src after RemoteCopy")
+	}
+}
+
+func TestParseDestURLRejectsFlagLikeSSHHost(t *testing.T) {
+	_, _, _, err := parseDestURL("ssh://-oProxyCommand=evilcmd/x")
+	if err == nil {
+		t.Fatal("parseDestURL accepted a host starting with '-'; want error")
+	}
+}
+
+func TestReadFrameRejectsOversized(t *testing.T) {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], maxControlFrameSize+1)
+	r := bytes.NewReader(lenBuf[:])
+	if _, err := readFrame(r, maxControlFrameSize); err == nil {
+		t.Fatal("readFrame accepted a length prefix over maxSize; want error")
+	}
+}
+
 // loggerDiscard is a Logf that throws away the logs given to it.
 func loggerDiscard(string, ...interface{}) {}
 
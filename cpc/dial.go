@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// parseDestURL splits a RemoteCopy destination URL into a dialFunc for its
+// scheme, the host part to pass to it, and the remote file path.
+//
+// Supported schemes:
+//
+//	ssh://host/path   runs `ssh host cpc-server` and speaks the same
+//	                  protocol over its stdin/stdout, so the session is
+//	                  authenticated the same way any other ssh command
+//	                  would be
+//
+// There's deliberately no unauthenticated tcp:// transport: ServeConn opens
+// whatever path the other end of the connection names and writes
+// attacker-controlled bytes at attacker-controlled offsets there, so it must
+// only ever run atop a transport that's already authenticated, like ssh.
+func parseDestURL(dstURL string) (dial dialFunc, host, path string, err error) {
+	switch {
+	case strings.HasPrefix(dstURL, "ssh://"):
+		rest := strings.TrimPrefix(dstURL, "ssh://")
+		host, path, ok := strings.Cut(rest, "/")
+		if !ok {
+			return nil, "", "", fmt.Errorf("ssh:// dest URL missing /path: %q", dstURL)
+		}
+		if strings.HasPrefix(host, "-") {
+			return nil, "", "", fmt.Errorf("ssh:// dest URL host must not start with %q: %q", "-", dstURL)
+		}
+		return dialSSH, host, "/" + path, nil
+	default:
+		return nil, "", "", fmt.Errorf("unrecognized dest URL scheme (want ssh://): %q", dstURL)
+	}
+}
+
+func dialSSH(ctx context.Context, host string) (io.ReadWriteCloser, error) {
+	// parseDestURL already rejects a host starting with "-", but pass "--"
+	// too so ssh itself never has a chance to interpret host as a flag.
+	cmd := exec.CommandContext(ctx, "ssh", "--", host, "cpc-server")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd: cmd, w: stdin, r: stdout}, nil
+}
+
+// sshConn adapts an `ssh -- host cpc-server` subprocess's stdin/stdout
+// into the io.ReadWriteCloser RemoteCopy talks the wire protocol over.
+type sshConn struct {
+	cmd *exec.Cmd
+	w   io.WriteCloser
+	r   io.ReadCloser
+}
+
+func (c *sshConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *sshConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *sshConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	return c.cmd.Wait()
+}
@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package cpc
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// directAlign is the buffer alignment O_DIRECT reads and writes need on
+// Linux. It's conservative; the true requirement is the underlying block
+// device's logical block size, almost always a divisor of this.
+const directAlign = 4096
+
+// openDirect tries to open name with O_DIRECT added to flag, so the copy
+// bypasses the page cache. Some filesystems (tmpfs, some network
+// filesystems, overlayfs in some configurations) reject O_DIRECT with
+// EINVAL; on that specific error we retry without it rather than failing
+// the whole copy over what's ultimately a performance hint.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+	if err == nil {
+		return f, nil
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return os.OpenFile(name, flag, perm)
+	}
+	return nil, err
+}
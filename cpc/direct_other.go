@@ -0,0 +1,19 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package cpc
+
+import "os"
+
+// directAlign is still used by alignedBuffer outside Linux, but the
+// alignment isn't needed there, since openDirect never actually bypasses
+// the page cache.
+const directAlign = 4096
+
+// openDirect opens name normally; O_DIRECT isn't portable, so Options.Direct
+// degrades to a no-op outside Linux rather than failing the copy.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ManifestEntry describes one page covered by a Manifest.
+type ManifestEntry struct {
+	PageIndex int    `json:"pageIndex"`
+	Offset    int64  `json:"offset"`
+	Len       int    `json:"len"`
+	SHA256    string `json:"sha256"` // hex-encoded
+}
+
+// Manifest is the "table of contents" sidecar cpc can write alongside a
+// copied file: a per-page digest listing that lets a later run cheaply
+// re-validate the file (or detect bit-rot) without a full byte-for-byte
+// compare against the original source.
+type Manifest struct {
+	FileSize int64           `json:"fileSize"`
+	PageSize int64           `json:"pageSize"`
+	Digest   string          `json:"digest"` // hex-encoded digest over Entries
+	Entries  []ManifestEntry `json:"entries"`
+}
+
+// buildManifest computes a Manifest describing f's current contents, read
+// in pageSize-sized pages.
+func buildManifest(f *os.File, size, pageSize int64) (Manifest, error) {
+	s := Syncer{PageSize: pageSize}
+	digests, err := s.PageDigests(f, size)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m := Manifest{
+		FileSize: size,
+		PageSize: pageSize,
+		Entries:  make([]ManifestEntry, len(digests)),
+	}
+	h := sha256.New()
+	for i, d := range digests {
+		off := int64(i) * pageSize
+		ln := pageSize
+		if rem := size - off; rem < ln {
+			ln = rem
+		}
+		m.Entries[i] = ManifestEntry{PageIndex: i, Offset: off, Len: int(ln), SHA256: fmt.Sprintf("%x", d)}
+		var hdr [16]byte
+		binary.BigEndian.PutUint64(hdr[:8], uint64(off))
+		binary.BigEndian.PutUint64(hdr[8:], uint64(ln))
+		h.Write(hdr[:])
+		h.Write(d[:])
+	}
+	m.Digest = fmt.Sprintf("%x", h.Sum(nil))
+	return m, nil
+}
+
+// writeManifestFile writes m as JSON to path.
+func writeManifestFile(path string, m Manifest) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// readManifestFile reads a Manifest previously written by writeManifestFile.
+func readManifestFile(path string) (Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("parsing manifest %v: %w", path, err)
+	}
+	return m, nil
+}
+
+// CorruptRange describes a span of a file whose contents no longer match
+// its manifest.
+type CorruptRange struct {
+	PageIndex int
+	Offset    int64
+	Len       int
+}
+
+// VerifyReport is the result of VerifyManifest.
+type VerifyReport struct {
+	PagesChecked int
+	Corrupt      []CorruptRange
+}
+
+// VerifyManifest re-reads fileName and checks every page against the
+// digests recorded in the manifest at manifestName, using up to NumCPU
+// workers in parallel. It's meant to cheaply re-validate a file that was
+// previously copied with Options.WriteManifest, to catch bit-rot or
+// accidental modification between copies without needing the original
+// source again.
+func VerifyManifest(ctx context.Context, logf Logf, fileName, manifestName string) (*VerifyReport, error) {
+	m, err := readManifestFile(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != m.FileSize {
+		return nil, fmt.Errorf("%v is %v bytes; manifest expects %v", fileName, fi.Size(), m.FileSize)
+	}
+	logf("verifying %v against %v (%v pages)", fileName, manifestName, len(m.Entries))
+
+	workc := make(chan ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		workc <- e
+	}
+	close(workc)
+
+	var mu sync.Mutex
+	var corrupt []CorruptRange
+	grp, ctx := errgroup.WithContext(ctx)
+	numCPU := runtime.NumCPU()
+	for i := 0; i < numCPU; i++ {
+		grp.Go(func() error {
+			buf := make([]byte, m.PageSize)
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case e, ok := <-workc:
+					if !ok {
+						return nil
+					}
+					b := buf[:e.Len]
+					if _, err := f.ReadAt(b, e.Offset); err != nil {
+						return fmt.Errorf("reading page %v at %v: %w", e.PageIndex, e.Offset, err)
+					}
+					if got := fmt.Sprintf("%x", chunkDigest(b)); got != e.SHA256 {
+						mu.Lock()
+						corrupt = append(corrupt, CorruptRange{PageIndex: e.PageIndex, Offset: e.Offset, Len: e.Len})
+						mu.Unlock()
+					}
+				}
+			}
+		})
+	}
+	if err := grp.Wait(); err != nil {
+		return nil, err
+	}
+	return &VerifyReport{PagesChecked: len(m.Entries), Corrupt: corrupt}, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+// Options configures optional Copy behavior. The zero value gets the
+// default: fixed-page comparison at the SQLite page size auto-detected from
+// src's header, or 4K if src isn't SQLite.
+type Options struct {
+	// Chunker, if non-nil, switches Copy from fixed-page comparison to
+	// content-defined chunking: chunk boundaries are picked by a rolling
+	// hash over the content instead of fixed offsets, so an insertion or
+	// deletion doesn't cascade into rewriting every page after it. It's
+	// mutually exclusive with PageSize, WriteManifest, VerifyManifest,
+	// Sparse, Direct, and Fsync; Copy returns an error if any of those are
+	// also set.
+	Chunker *FastCDC
+
+	// PageSize, if non-zero, overrides the page size Copy compares and
+	// writes at. Copy otherwise auto-detects the SQLite page size from the
+	// source's header, falling back to 4K. Set this when copying a
+	// non-SQLite format with its own natural block size, e.g. an ext4
+	// filesystem image (4K) or an InnoDB file (commonly 16K).
+	PageSize int
+
+	// WriteManifest, if non-empty, names a file Copy writes a per-page
+	// digest manifest to after the copy completes, for later use with
+	// VerifyManifest.
+	WriteManifest string
+
+	// VerifyManifest, if non-empty, names a manifest Copy checks dst
+	// against after writing it, as a sanity check that what landed on disk
+	// is what Copy thinks it wrote.
+	VerifyManifest string
+
+	// Sparse, if true, punches a hole in dst instead of writing zeroes for
+	// any all-zero source page, preserving dst's sparseness. Linux only;
+	// it's silently ignored elsewhere and on filesystems that reject
+	// FALLOC_FL_PUNCH_HOLE.
+	Sparse bool
+
+	// Direct, if true, opens src and dst with O_DIRECT so the copy bypasses
+	// the page cache, which matters when copying a multi-gigabyte database
+	// that would otherwise evict other hot pages. Falls back to a regular
+	// open if the filesystem rejects O_DIRECT.
+	Direct bool
+
+	// Fsync, if true, syncs dst to stable storage before Copy returns.
+	// Without it, a crash right after Copy returns can lose writes it
+	// already reported as successful.
+	Fsync bool
+}
+
+// WithChunker returns an Options value that makes Copy use c to cut src and
+// dst into content-defined chunks instead of fixed pages.
+func WithChunker(c FastCDC) Options {
+	return Options{Chunker: &c}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// sqliteMagic is the fixed 16-byte header every SQLite database file starts
+// with.
+const sqliteMagic = "SQLite format 3\x00"
+
+// isValidSQLitePageSize reports whether n is a page size SQLite could
+// actually have written: a power of two between 512 and 65536 inclusive.
+func isValidSQLitePageSize(n int64) bool {
+	return n >= 512 && n <= 65536 && bits.OnesCount64(uint64(n)) == 1
+}
+
+// detectSQLitePageSize reads f's header and, if it looks like a SQLite
+// database, returns its page size and true. Otherwise it returns (0, false).
+// A genuine I/O error reading the header (as opposed to the file simply
+// being too short to be SQLite) is returned as err.
+//
+// The page size is stored as a big-endian uint16 at byte offset 16: the
+// literal value, except 1 means 65536 (the one page size that doesn't fit
+// in a uint16). A file that starts with the SQLite magic but has a
+// corrupt or zero page-size field doesn't get a free pass just because the
+// magic matched: its declared size is validated like any other, and an
+// invalid one is reported as an error rather than silently falling back.
+func detectSQLitePageSize(f *os.File) (int64, bool, error) {
+	var hdr [18]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if string(hdr[:16]) != sqliteMagic {
+		return 0, false, nil
+	}
+	raw := binary.BigEndian.Uint16(hdr[16:18])
+	pageSize := int64(raw)
+	if raw == 1 {
+		pageSize = 65536
+	}
+	if !isValidSQLitePageSize(pageSize) {
+		return 0, false, fmt.Errorf("file has SQLite magic but an invalid page size field (%d)", raw)
+	}
+	return pageSize, true, nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// protocolMagic identifies the cpc wire protocol and its version. It's the
+// first thing sent on a new connection, so an old client talking to a new
+// server (or vice versa) fails fast with a clear error instead of a
+// confusing decode failure further in.
+const protocolMagic = "CPC1"
+
+// HashAlgo identifies the digest algorithm used for page comparisons over
+// the wire. It's part of the handshake so the wire format can grow a faster
+// or stronger hash later without breaking old clients or servers outright.
+type HashAlgo byte
+
+const (
+	HashSHA256 HashAlgo = iota
+)
+
+// handshake is sent by the client immediately after connecting, to
+// negotiate the page size and hash algorithm used for the rest of the
+// session and to name which destination file the server should open.
+type handshake struct {
+	PageSize int64
+	Hash     HashAlgo
+	DestPath string
+}
+
+// handshakeAck is the server's reply to a handshake.
+type handshakeAck struct {
+	OK   bool
+	Err  string
+	Size int64 // current size of the destination file, 0 if it doesn't exist yet
+}
+
+// doneMsg is sent by the client once it has sent every write frame, to tell
+// the server the final file size (for truncation) and request the final
+// stats.
+type doneMsg struct {
+	FinalSize int64
+}
+
+// writeOp is one "copy these bytes to this offset" instruction sent by the
+// client for any page that didn't already match the server's digest.
+type writeOp struct {
+	Off  int64
+	Data []byte
+}
+
+// statsMsg carries the server's final tally back to the client.
+type statsMsg struct {
+	PagesWritten    int64
+	PagesUnmodified int64
+}
+
+// maxControlFrameSize bounds every frame except the digest list: handshake,
+// ack, a single writeOp (one page's worth of data plus an 8-byte offset),
+// done, and stats. 8MiB is far more than any realistic page size needs, but
+// still bounds the allocation readFrame makes for a corrupt or adversarial
+// length prefix.
+const maxControlFrameSize = 8 << 20
+
+// maxDigestFrameSize bounds the one frame that legitimately scales with file
+// size: the server's per-page digest list, at 32 bytes per page. 1GiB is
+// enough for 32Mi (33,554,432) pages, i.e. a 128GiB file at 4K pages, while
+// still rejecting a garbled length prefix before it turns into a
+// multi-gigabyte allocation.
+const maxDigestFrameSize = 1 << 30
+
+// writeFrame writes b as a length-prefixed frame: a big-endian uint32
+// length followed by that many bytes.
+func writeFrame(w io.Writer, b []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads one length-prefixed frame written by writeFrame. It
+// rejects a frame whose declared length exceeds maxSize before allocating a
+// buffer for it, so a corrupt or adversarial length prefix can't force a
+// multi-gigabyte allocation.
+func readFrame(r io.Reader, maxSize uint32) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxSize {
+		return nil, fmt.Errorf("cpc: frame length %d exceeds max %d", n, maxSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func encodeHandshake(h handshake) []byte {
+	b := make([]byte, 0, len(protocolMagic)+9+len(h.DestPath))
+	b = append(b, protocolMagic...)
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], uint64(h.PageSize))
+	b = append(b, tmp[:]...)
+	b = append(b, byte(h.Hash))
+	b = append(b, h.DestPath...)
+	return b
+}
+
+func decodeHandshake(b []byte) (handshake, error) {
+	if len(b) < len(protocolMagic)+9 || string(b[:len(protocolMagic)]) != protocolMagic {
+		return handshake{}, fmt.Errorf("cpc: bad handshake magic")
+	}
+	b = b[len(protocolMagic):]
+	pageSize := int64(binary.BigEndian.Uint64(b[:8]))
+	hash := HashAlgo(b[8])
+	path := string(b[9:])
+	return handshake{PageSize: pageSize, Hash: hash, DestPath: path}, nil
+}
+
+func encodeHandshakeAck(a handshakeAck) []byte {
+	b := make([]byte, 0, 9+len(a.Err))
+	if a.OK {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], uint64(a.Size))
+	b = append(b, tmp[:]...)
+	b = append(b, a.Err...)
+	return b
+}
+
+func decodeHandshakeAck(b []byte) (handshakeAck, error) {
+	if len(b) < 9 {
+		return handshakeAck{}, fmt.Errorf("cpc: short handshake ack")
+	}
+	return handshakeAck{
+		OK:   b[0] == 1,
+		Size: int64(binary.BigEndian.Uint64(b[1:9])),
+		Err:  string(b[9:]),
+	}, nil
+}
+
+// encodeDigests packs a []digest256 for the wire as a flat byte slice.
+func encodeDigests(digests []digest256) []byte {
+	b := make([]byte, len(digests)*32)
+	for i, d := range digests {
+		copy(b[i*32:], d[:])
+	}
+	return b
+}
+
+func decodeDigests(b []byte) ([]digest256, error) {
+	if len(b)%32 != 0 {
+		return nil, fmt.Errorf("cpc: digest list length %d not a multiple of 32", len(b))
+	}
+	out := make([]digest256, len(b)/32)
+	for i := range out {
+		copy(out[i][:], b[i*32:])
+	}
+	return out, nil
+}
+
+func encodeWriteOp(op writeOp) []byte {
+	b := make([]byte, 8, 8+len(op.Data))
+	binary.BigEndian.PutUint64(b, uint64(op.Off))
+	return append(b, op.Data...)
+}
+
+func decodeWriteOp(b []byte) (writeOp, error) {
+	if len(b) < 8 {
+		return writeOp{}, fmt.Errorf("cpc: short write op")
+	}
+	return writeOp{Off: int64(binary.BigEndian.Uint64(b[:8])), Data: b[8:]}, nil
+}
+
+func encodeDone(d doneMsg) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(d.FinalSize))
+	return b[:]
+}
+
+func decodeDone(b []byte) (doneMsg, error) {
+	if len(b) < 8 {
+		return doneMsg{}, fmt.Errorf("cpc: short done message")
+	}
+	return doneMsg{FinalSize: int64(binary.BigEndian.Uint64(b[:8]))}, nil
+}
+
+func encodeStats(s statsMsg) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], uint64(s.PagesWritten))
+	binary.BigEndian.PutUint64(b[8:], uint64(s.PagesUnmodified))
+	return b
+}
+
+func decodeStats(b []byte) (statsMsg, error) {
+	if len(b) < 16 {
+		return statsMsg{}, fmt.Errorf("cpc: short stats message")
+	}
+	return statsMsg{
+		PagesWritten:    int64(binary.BigEndian.Uint64(b[:8])),
+		PagesUnmodified: int64(binary.BigEndian.Uint64(b[8:])),
+	}, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ServeConn runs the server side of the cpc remote delta-sync protocol on
+// conn until the client sends its done message or the connection closes.
+// It's intended to be called once per accepted connection, typically by the
+// cpc-server command; ServeConn itself does no listening or dialing.
+//
+// The server trusts the handshake's destination path outright, so conn
+// must already be an authenticated, private transport (an SSH session, for
+// instance). ServeConn has no notion of authentication or access control of
+// its own, so callers should never wire it to a bare, unauthenticated
+// socket.
+func ServeConn(ctx context.Context, logf Logf, conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	hsFrame, err := readFrame(conn, maxControlFrameSize)
+	if err != nil {
+		return fmt.Errorf("reading handshake: %w", err)
+	}
+	hs, err := decodeHandshake(hsFrame)
+	if err != nil {
+		return writeHandshakeErr(conn, err)
+	}
+	if hs.Hash != HashSHA256 {
+		return writeHandshakeErr(conn, fmt.Errorf("unsupported hash algo %v", hs.Hash))
+	}
+
+	dstF, err := os.OpenFile(hs.DestPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return writeHandshakeErr(conn, err)
+	}
+	defer dstF.Close()
+	fi, err := dstF.Stat()
+	if err != nil {
+		return writeHandshakeErr(conn, err)
+	}
+
+	s := Syncer{PageSize: hs.PageSize}
+	digests, err := s.PageDigests(dstF, fi.Size())
+	if err != nil {
+		return writeHandshakeErr(conn, err)
+	}
+
+	if err := writeFrame(conn, encodeHandshakeAck(handshakeAck{OK: true, Size: fi.Size()})); err != nil {
+		return err
+	}
+	logf("serving %v (%v bytes, %v pages) to client", hs.DestPath, fi.Size(), len(digests))
+	if err := writeFrame(conn, encodeDigests(digests)); err != nil {
+		return err
+	}
+
+	var pagesWritten, pagesUnmodified int64
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		frame, err := readFrame(conn, maxControlFrameSize)
+		if err != nil {
+			return fmt.Errorf("reading client frame: %w", err)
+		}
+		if len(frame) == 8 {
+			// A bare 8-byte frame is the done message; writeOp frames are
+			// always longer (an 8-byte offset plus at least one data byte,
+			// since a zero-length page diff is never sent).
+			done, err := decodeDone(frame)
+			if err != nil {
+				return err
+			}
+			if err := dstF.Truncate(done.FinalSize); err != nil {
+				return err
+			}
+			// Each writeOp carries exactly one page, so every other page
+			// of the final file was left as it was.
+			pagesUnmodified = s.NumPages(done.FinalSize) - pagesWritten
+			return writeFrame(conn, encodeStats(statsMsg{PagesWritten: pagesWritten, PagesUnmodified: pagesUnmodified}))
+		}
+		op, err := decodeWriteOp(frame)
+		if err != nil {
+			return err
+		}
+		if _, err := dstF.WriteAt(op.Data, op.Off); err != nil {
+			return err
+		}
+		pagesWritten++
+	}
+}
+
+func writeHandshakeErr(conn io.Writer, err error) error {
+	writeFrame(conn, encodeHandshakeAck(handshakeAck{OK: false, Err: err.Error()}))
+	return err
+}
+
+// dialFunc opens a connection to a remote cpc-server, given the host part
+// of a dest URL (e.g. "host" for ssh://).
+type dialFunc func(ctx context.Context, host string) (io.ReadWriteCloser, error)
+
+// RemoteCopy is like Copy, but dstURL names a destination file on another
+// machine: "ssh://host/path" launches cpc-server over an SSH session and
+// speaks the delta-sync protocol over its stdin/stdout, authenticated the
+// same way any other ssh command is. Only mismatched pages cross the
+// network.
+func RemoteCopy(ctx context.Context, logf Logf, srcName, dstURL string) (*Stats, error) {
+	dial, host, destPath, err := parseDestURL(dstURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %v: %w", dstURL, err)
+	}
+	defer conn.Close()
+
+	srcF, err := os.Open(srcName)
+	if err != nil {
+		return nil, err
+	}
+	defer srcF.Close()
+
+	return remoteCopyConn(ctx, logf, srcF, destPath, conn)
+}
+
+// remoteCopyConn is RemoteCopy's wire-protocol client, factored out so tests
+// can drive it over an in-process net.Pipe paired with ServeConn, without
+// needing a real dialFunc or network listener.
+func remoteCopyConn(ctx context.Context, logf Logf, srcF *os.File, destPath string, conn io.ReadWriteCloser) (*Stats, error) {
+	t0 := time.Now()
+
+	fi, err := srcF.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	pageSize := int64(defaultPageSize)
+	if detected, ok, err := detectSQLitePageSize(srcF); err != nil {
+		return nil, fmt.Errorf("detecting SQLite page size: %w", err)
+	} else if ok {
+		pageSize = detected
+	}
+
+	if err := writeFrame(conn, encodeHandshake(handshake{PageSize: pageSize, Hash: HashSHA256, DestPath: destPath})); err != nil {
+		return nil, err
+	}
+	ackFrame, err := readFrame(conn, maxControlFrameSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading handshake ack: %w", err)
+	}
+	ack, err := decodeHandshakeAck(ackFrame)
+	if err != nil {
+		return nil, err
+	}
+	if !ack.OK {
+		return nil, fmt.Errorf("cpc-server: %s", ack.Err)
+	}
+
+	digestFrame, err := readFrame(conn, maxDigestFrameSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading digest list: %w", err)
+	}
+	dstDigests, err := decodeDigests(digestFrame)
+	if err != nil {
+		return nil, err
+	}
+	logf("server has %v at %v bytes, %v pages; local src is %v bytes", destPath, ack.Size, len(dstDigests), size)
+
+	s := Syncer{PageSize: pageSize}
+	numPages := s.NumPages(size)
+	var pagesWritten, pagesMatched int64
+	for i := int64(0); i < numPages; i++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		off := i * pageSize
+		ln := pageSize
+		if rem := size - off; rem < ln {
+			ln = rem
+		}
+		buf, err := s.ReadPage(srcF, off, int(ln))
+		if err != nil {
+			return nil, err
+		}
+		if int(i) < len(dstDigests) && dstDigests[i] == chunkDigest(buf) {
+			pagesMatched++
+			continue
+		}
+		if err := writeFrame(conn, encodeWriteOp(writeOp{Off: off, Data: buf})); err != nil {
+			return nil, err
+		}
+		pagesWritten++
+	}
+	if err := writeFrame(conn, encodeDone(doneMsg{FinalSize: size})); err != nil {
+		return nil, err
+	}
+	statsFrame, err := readFrame(conn, maxControlFrameSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading final stats: %w", err)
+	}
+	st, err := decodeStats(statsFrame)
+	if err != nil {
+		return nil, err
+	}
+
+	d := time.Since(t0)
+	logf("remote copy done in %v: %v pages sent, %v unchanged", d.Round(time.Millisecond), pagesWritten, pagesMatched)
+	return &Stats{
+		Duration:        d,
+		PageSize:        pageSize,
+		PagesWritten:    st.PagesWritten,
+		PagesUnmodified: st.PagesUnmodified,
+	}, nil
+}
@@ -0,0 +1,293 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rollBlock is the block size (S) used by the rolling-hash matcher, both for
+// the fixed blocks indexed in dst and for the sliding window over src.
+const rollBlock = 4 << 10
+
+// adlerMod is the modulus used by the weak rolling checksum, same as Adler-32.
+const adlerMod = 65521
+
+// strongSum is a truncated cryptographic digest used to confirm a weak-hash
+// hit before trusting it.
+type strongSum [16]byte
+
+func strongHash(b []byte) strongSum {
+	full := sha256.Sum256(b)
+	var s strongSum
+	copy(s[:], full[:16])
+	return s
+}
+
+// weakSig is the Adler-32-style rolling checksum described in rsync's
+// algorithm: sig = a | (b<<16).
+type weakSig uint32
+
+// weakHash computes the initial weak signature of b, along with the a and b
+// components needed to roll it forward.
+func weakHash(b []byte) (sig weakSig, a, bb uint32) {
+	n := uint32(len(b))
+	for i, c := range b {
+		a += uint32(c)
+		bb += (n - uint32(i)) * uint32(c)
+	}
+	a %= adlerMod
+	bb %= adlerMod
+	return weakSig(a | bb<<16), a, bb
+}
+
+// rollOut rolls the window forward by one byte: out leaves the window, in
+// enters it. n is the window length.
+func rollOut(a, b, n uint32, out, in byte) (sig weakSig, na, nb uint32) {
+	na = (a + adlerMod - uint32(out)%adlerMod + uint32(in)) % adlerMod
+	nb = (b + adlerMod - (n*uint32(out))%adlerMod + na) % adlerMod
+	return weakSig(na | nb<<16), na, nb
+}
+
+// dstBlock records where a fixed-size block of dst lives, for later lookup
+// by weak signature.
+type dstBlock struct {
+	off    int64
+	strong strongSum
+}
+
+// indexDst reads dst in fixed rollBlock-sized chunks and returns a map from
+// weak signature to the (possibly several) blocks that share it.
+func indexDst(dstF *os.File, size int64) (map[weakSig][]dstBlock, error) {
+	index := make(map[weakSig][]dstBlock)
+	buf := make([]byte, rollBlock)
+	for off := int64(0); off < size; off += rollBlock {
+		n := rollBlock
+		if rem := size - off; rem < int64(n) {
+			n = int(rem)
+		}
+		if _, err := dstF.ReadAt(buf[:n], off); err != nil {
+			return nil, fmt.Errorf("indexing dst at %d: %w", off, err)
+		}
+		sig, _, _ := weakHash(buf[:n])
+		index[sig] = append(index[sig], dstBlock{off: off, strong: strongHash(buf[:n])})
+	}
+	return index, nil
+}
+
+// rollingWindow holds the rollBlock bytes currently under consideration for
+// a match, as a ring buffer: rolling the window forward by one byte is an
+// O(1) overwrite-and-advance instead of an O(rollBlock) shift. It lets
+// CopyRolling scan src a byte at a time without ever holding more than a
+// window's worth of it in memory.
+type rollingWindow struct {
+	buf     []byte // len rollBlock, the ring's backing storage
+	head    int    // index of the oldest byte, valid once len == rollBlock
+	len     int    // number of valid bytes, caps at rollBlock
+	ordered []byte // scratch space for materialize, reused across calls
+}
+
+func newRollingWindow() *rollingWindow {
+	return &rollingWindow{buf: make([]byte, rollBlock), ordered: make([]byte, rollBlock)}
+}
+
+// fill replaces the window's contents by reading up to rollBlock bytes from
+// r, resetting the ring to start fresh (no partial roll in progress).
+func (w *rollingWindow) fill(r *bufio.Reader) error {
+	n, err := io.ReadFull(r, w.buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	w.head = 0
+	w.len = n
+	return nil
+}
+
+// full reports whether the window currently holds a complete rollBlock
+// bytes, i.e. whether it's eligible for a weak-hash lookup.
+func (w *rollingWindow) full() bool { return w.len == rollBlock }
+
+// bytes returns the window's contents in order. The returned slice is only
+// valid until the next call to fill or roll.
+func (w *rollingWindow) bytes() []byte {
+	if w.head == 0 {
+		return w.buf[:w.len]
+	}
+	k := copy(w.ordered, w.buf[w.head:])
+	copy(w.ordered[k:], w.buf[:w.head])
+	return w.ordered
+}
+
+// roll advances the window by one byte: the oldest byte is evicted (and
+// returned) and in takes its place.
+func (w *rollingWindow) roll(in byte) (out byte) {
+	out = w.buf[w.head]
+	w.buf[w.head] = in
+	w.head = (w.head + 1) % rollBlock
+	return out
+}
+
+// CopyRolling is like Copy, but instead of comparing fixed-offset pages it
+// does rsync-style delta matching: it indexes dst in fixed rollBlock-sized
+// blocks by a rolling checksum, then slides a window across src looking for
+// blocks that already exist somewhere in dst (at any offset). This handles
+// content that's been shifted by an insertion or deletion, where the
+// page-aligned Copy would otherwise have to rewrite everything after the
+// shift.
+func CopyRolling(ctx context.Context, logf Logf, srcName, dstName string) (*Stats, error) {
+	t0 := time.Now()
+
+	srcF, err := os.Open(srcName)
+	if err != nil {
+		return nil, err
+	}
+	defer srcF.Close()
+	srcFi, err := srcF.Stat()
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReaderSize(srcF, 1<<20)
+
+	dstF, err := os.OpenFile(dstName, os.O_CREATE|os.O_RDWR, srcFi.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	defer dstF.Close()
+	dstFi, err := dstF.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := indexDst(dstF, dstFi.Size())
+	if err != nil {
+		return nil, err
+	}
+	logf("indexed dst %v (%v bytes) into %v distinct weak signatures", dstName, dstFi.Size(), len(index))
+
+	tmpF, err := ioutil.TempFile(filepath.Dir(dstName), filepath.Base(dstName)+".cpc-rolling-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpName := tmpF.Name()
+	defer os.Remove(tmpName) // no-op once renamed over dstName
+	// tmpF replaces dst below, so give it src's permissions rather than
+	// TempFile's 0600.
+	if err := tmpF.Chmod(srcFi.Mode().Perm()); err != nil {
+		tmpF.Close()
+		return nil, err
+	}
+
+	var bytesMatched, bytesLiteral, windowsScanned int64
+
+	window := newRollingWindow()
+	if err := window.fill(src); err != nil {
+		tmpF.Close()
+		return nil, err
+	}
+
+	var a, b uint32
+	var sig weakSig
+	haveHash := false
+	for window.full() {
+		if ctx.Err() != nil {
+			tmpF.Close()
+			return nil, ctx.Err()
+		}
+		w := window.bytes()
+		if !haveHash {
+			sig, a, b = weakHash(w)
+			haveHash = true
+		}
+		windowsScanned++
+		matched := false
+		if cands, ok := index[sig]; ok {
+			strong := strongHash(w)
+			for _, c := range cands {
+				if c.strong == strong {
+					dstBuf := make([]byte, len(w))
+					if _, err := dstF.ReadAt(dstBuf, c.off); err != nil {
+						tmpF.Close()
+						return nil, err
+					}
+					if _, err := tmpF.Write(dstBuf); err != nil {
+						tmpF.Close()
+						return nil, err
+					}
+					bytesMatched += int64(len(w))
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			if err := window.fill(src); err != nil {
+				tmpF.Close()
+				return nil, err
+			}
+			haveHash = false
+			continue
+		}
+		// No match at this position: roll the window forward by one byte
+		// in O(1) rather than recomputing the checksum from scratch. The
+		// evicted byte will never be reconsidered, so it can be written out
+		// as a literal immediately instead of being held in memory.
+		next, err := src.ReadByte()
+		if err == io.EOF {
+			break // no next byte to roll in; remainder becomes a literal tail
+		} else if err != nil {
+			tmpF.Close()
+			return nil, err
+		}
+		outByte := window.roll(next)
+		if _, err := tmpF.Write([]byte{outByte}); err != nil {
+			tmpF.Close()
+			return nil, err
+		}
+		bytesLiteral++
+		sig, a, b = rollOut(a, b, rollBlock, outByte, next)
+	}
+	// Whatever's left in the window, plus anything still unread, is shorter
+	// than a full block and becomes a literal tail.
+	tail := window.bytes()[:window.len]
+	if _, err := tmpF.Write(tail); err != nil {
+		tmpF.Close()
+		return nil, err
+	}
+	bytesLiteral += int64(window.len)
+	if n, err := io.Copy(tmpF, src); err != nil {
+		tmpF.Close()
+		return nil, err
+	} else {
+		bytesLiteral += n
+	}
+
+	if err := tmpF.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpName, dstName); err != nil {
+		return nil, err
+	}
+
+	d := time.Since(t0)
+	logf("rolling copy done in %v: %v bytes matched, %v literal, %v windows scanned",
+		d.Round(time.Millisecond), bytesMatched, bytesLiteral, windowsScanned)
+	return &Stats{
+		Duration:       d,
+		PageSize:       rollBlock,
+		BytesMatched:   bytesMatched,
+		BytesLiteral:   bytesLiteral,
+		WindowsScanned: windowsScanned,
+	}, nil
+}
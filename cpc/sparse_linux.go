@@ -0,0 +1,29 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package cpc
+
+import (
+	"os"
+	"syscall"
+)
+
+// These aren't in the syscall package, which only defines the fallocate
+// mode bits it already has a use for.
+const (
+	falloc_FL_KEEP_SIZE  = 0x01
+	falloc_FL_PUNCH_HOLE = 0x02
+)
+
+// punchHole punches a hole of length ln at off in f, preserving f's
+// current size. It reports whether the filesystem supports it; callers
+// should fall back to writing zeroes if it doesn't.
+func punchHole(f *os.File, off int64, ln int) (ok bool, err error) {
+	err = syscall.Fallocate(int(f.Fd()), falloc_FL_KEEP_SIZE|falloc_FL_PUNCH_HOLE, off, int64(ln))
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return false, nil
+	}
+	return err == nil, err
+}
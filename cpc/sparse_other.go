@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package cpc
+
+import "os"
+
+// punchHole always reports unsupported outside Linux; Options.Sparse falls
+// back to writing zeroes in that case.
+func punchHole(f *os.File, off int64, ln int) (ok bool, err error) {
+	return false, nil
+}
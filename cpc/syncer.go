@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cpc
+
+import (
+	"bytes"
+	"io"
+)
+
+// Syncer holds the page-comparison primitives shared by the local Copy and
+// the remote delta-sync client/server (see cpc-server), generalized to
+// operate on io.ReaderAt/io.WriterAt instead of requiring an *os.File. This
+// is what lets the same page-granularity logic run against a local
+// destination or against a page-digest list fetched over the network.
+type Syncer struct {
+	// PageSize is the page size to use; zero means defaultPageSize.
+	PageSize int64
+}
+
+func (s Syncer) pageSize() int64 {
+	if s.PageSize > 0 {
+		return s.PageSize
+	}
+	return defaultPageSize
+}
+
+// NumPages returns the number of pages needed to cover size bytes at s's
+// page size.
+func (s Syncer) NumPages(size int64) int64 {
+	ps := s.pageSize()
+	return (size + ps - 1) / ps
+}
+
+// PageDigests computes the digest256 of every page of r, up to size bytes.
+// It's used by the remote server to describe its current copy of the
+// destination file without sending the file itself.
+func (s Syncer) PageDigests(r io.ReaderAt, size int64) ([]digest256, error) {
+	ps := s.pageSize()
+	out := make([]digest256, s.NumPages(size))
+	buf := make([]byte, ps)
+	for i := range out {
+		off := int64(i) * ps
+		ln := ps
+		if rem := size - off; rem < ln {
+			ln = rem
+		}
+		if _, err := r.ReadAt(buf[:ln], off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		out[i] = chunkDigest(buf[:ln])
+	}
+	return out, nil
+}
+
+// ReadPage reads the ln bytes at off from r into a freshly allocated slice.
+func (s Syncer) ReadPage(r io.ReaderAt, off int64, ln int) ([]byte, error) {
+	buf := make([]byte, ln)
+	if err := s.ReadPageInto(r, off, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadPageInto reads len(buf) bytes at off from r into buf. It's the
+// buffer-reusing counterpart to ReadPage, for callers like Copy's
+// per-worker loop that read many pages in sequence and don't want to
+// allocate a page-sized buffer every time.
+func (s Syncer) ReadPageInto(r io.ReaderAt, off int64, buf []byte) error {
+	if _, err := r.ReadAt(buf, off); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// SamePage reports whether the bytes at off in src and dst are equal,
+// reading ln bytes from each.
+func (s Syncer) SamePage(src, dst io.ReaderAt, off int64, ln int) (bool, error) {
+	bufSrc, err := s.ReadPage(src, off, ln)
+	if err != nil {
+		return false, err
+	}
+	bufDst, err := s.ReadPage(dst, off, ln)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(bufSrc, bufDst), nil
+}
+
+// SamePageInto is the buffer-reusing counterpart to SamePage: it reads into
+// the caller-provided bufSrc and bufDst (each exactly as long as the page
+// being compared) instead of allocating fresh ones.
+func (s Syncer) SamePageInto(src, dst io.ReaderAt, off int64, bufSrc, bufDst []byte) (bool, error) {
+	if err := s.ReadPageInto(src, off, bufSrc); err != nil {
+		return false, err
+	}
+	if err := s.ReadPageInto(dst, off, bufDst); err != nil {
+		return false, err
+	}
+	return bytes.Equal(bufSrc, bufDst), nil
+}